@@ -0,0 +1,31 @@
+package bucket
+
+import (
+    "encoding/binary"
+    "errors"
+    "math"
+)
+
+// EncodeVals packs vals as a flat little-endian float64 array. This is
+// the on-disk shape the redis store already uses for a bucket's Vals
+// column; store.PostgresStore reuses it so a bucket's serialized form
+// doesn't depend on which backend it's headed to.
+func EncodeVals(vals []float64) ([]byte, error) {
+    buf := make([]byte, 8*len(vals))
+    for i, v := range vals {
+        binary.LittleEndian.PutUint64(buf[i*8:], math.Float64bits(v))
+    }
+    return buf, nil
+}
+
+// DecodeVals is the inverse of EncodeVals.
+func DecodeVals(data []byte) ([]float64, error) {
+    if len(data)%8 != 0 {
+        return nil, errors.New("bucket: vals encoding is not a multiple of 8 bytes")
+    }
+    vals := make([]float64, len(data)/8)
+    for i := range vals {
+        vals[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[i*8:]))
+    }
+    return vals, nil
+}
@@ -0,0 +1,80 @@
+package bucket
+
+import (
+    "bytes"
+    "encoding/gob"
+    "time"
+)
+
+// walEntry is the stable, on-disk shape of a bucket for the receiver's
+// write-ahead log. It is kept separate from Bucket/Id themselves so
+// that in-memory field additions don't silently change what's on disk;
+// bump walEntryVersion and add a migration branch in DecodeWAL
+// instead.
+const walEntryVersion = 1
+
+type walEntry struct {
+    Version int
+
+    // bucket.Id
+    Auth       string
+    Name       string
+    Source     string
+    Units      string
+    Type       string
+    Tags       string
+    Time       int64 // UnixNano
+    Resolution int64 // time.Duration
+
+    // bucket.Bucket
+    Vals  []float64
+    Sum   float64
+    Count int
+}
+
+// EncodeWAL serializes b into the stable WAL wire format.
+func EncodeWAL(b *Bucket) ([]byte, error) {
+    e := walEntry{
+        Version:    walEntryVersion,
+        Auth:       b.Id.Auth,
+        Name:       b.Id.Name,
+        Source:     b.Id.Source,
+        Units:      b.Id.Units,
+        Type:       b.Id.Type,
+        Tags:       b.Id.Tags,
+        Time:       b.Id.Time.UnixNano(),
+        Resolution: int64(b.Id.Resolution),
+        Vals:       b.Vals,
+        Sum:        b.Sum,
+        Count:      b.Count,
+    }
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(&e); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// DecodeWAL is the inverse of EncodeWAL, used when replaying the WAL
+// on startup.
+func DecodeWAL(data []byte) (*Bucket, error) {
+    var e walEntry
+    if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil {
+        return nil, err
+    }
+    return &Bucket{
+        Id: &Id{
+            Auth:       e.Auth,
+            Name:       e.Name,
+            Source:     e.Source,
+            Units:      e.Units,
+            Type:       e.Type,
+            Tags:       e.Tags,
+            Time:       time.Unix(0, e.Time),
+            Resolution: time.Duration(e.Resolution),
+        },
+        Vals:  e.Vals,
+        Sum:   e.Sum,
+        Count: e.Count,
+    }, nil
+}
@@ -0,0 +1,6 @@
+package metrics
+
+// TenantKey satisfies outlet/httpbatch.Payload, grouping DataDog
+// metric payloads by the api_key extracted from the log line's basic
+// auth, the same key DataDogOutlet.outlet() later posts under.
+func (d *DataDog) TenantKey() string { return d.Auth }
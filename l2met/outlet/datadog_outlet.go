@@ -4,18 +4,22 @@
 package outlet
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"log"
 	"net"
 	"net/http"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/winkapp/log-shuttle/l2met/bucket"
 	"github.com/winkapp/log-shuttle/l2met/metchan"
 	"github.com/winkapp/log-shuttle/l2met/metrics"
+	"github.com/winkapp/log-shuttle/l2met/outlet/faultinject"
+	"github.com/winkapp/log-shuttle/l2met/outlet/httpbatch"
 	"github.com/winkapp/log-shuttle/l2met/reader"
+	"golang.org/x/time/rate"
 	"strings"
 	"github.com/winkapp/log-shuttle"
 )
@@ -31,6 +35,79 @@ type DataDogOutlet struct {
 	Mchan       *metchan.Channel
 	verbose     bool
 	quiet       bool
+
+	outletTtl time.Duration
+
+	// Per-api_key rate limiting so a single runaway tenant can't
+	// burn the shared DataDog HTTP client budget.
+	keyLimiterMu sync.RWMutex
+	keyLimiters  map[string]*rateLimiterEntry
+	keyInterval  time.Duration
+	keyBurst     int
+
+	// Guards against an attacker minting unbounded per-key limiters
+	// by sending thousands of distinct fake auth headers, same idea
+	// as the acme/autocert host policy limiter.
+	newKeyLimiter *rate.Limiter
+
+	// Caps total submissions across all keys.
+	globalLimiter *rate.Limiter
+
+	keyLimiterIdleTtl time.Duration
+
+	retryBase   time.Duration
+	retryCap    time.Duration
+	retryBudget *retryBudget
+
+	// Tracks posts that have been handed to postWithRetry but haven't
+	// finished (succeeded or given up). Payloads dropped by a rate
+	// limiter never reach postWithRetry and are not tracked here.
+	// Wait lets callers know when it's safe to shut down
+	// without abandoning in-flight DataDog submissions.
+	inFlight sync.WaitGroup
+
+	done chan struct{}
+}
+
+// retryBudget is a token bucket that caps how many retries may be in
+// flight relative to the rate of successful posts. It refills on every
+// successful post rather than on a timer so the budget naturally tracks
+// how healthy DataDog currently looks.
+type retryBudget struct {
+	mu          sync.Mutex
+	tokens      float64
+	max         float64
+	refillRatio float64
+}
+
+func newRetryBudget(max, refillRatio float64) *retryBudget {
+	return &retryBudget{tokens: max, max: max, refillRatio: refillRatio}
+}
+
+func (b *retryBudget) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.refillRatio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *retryBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiterEntry pairs a limiter with the last time it was used so
+// the sweeper can evict idle entries.
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
 }
 
 func buildDataDogClient(ttl time.Duration) *http.Client {
@@ -58,12 +135,80 @@ func NewDataDogOutlet(cfg shuttle.Config, r *reader.Reader) *DataDogOutlet {
 		rdr:         r,
 		verbose:     cfg.Verbose,
 		quiet:       cfg.Quiet,
+
+		outletTtl:         cfg.L2met_OutletTtl,
+		keyLimiters:       make(map[string]*rateLimiterEntry),
+		keyInterval:       cfg.L2met_PerKeyInterval,
+		keyBurst:          cfg.L2met_PerKeyBurst,
+		newKeyLimiter:     rate.NewLimiter(rate.Every(cfg.L2met_NewKeyInterval), cfg.L2met_NewKeyBurst),
+		globalLimiter:     rate.NewLimiter(rate.Every(cfg.L2met_GlobalInterval), cfg.L2met_GlobalBurst),
+		keyLimiterIdleTtl: cfg.L2met_KeyLimiterIdleTtl,
+
+		retryBase:   cfg.L2met_RetryBackoffBase,
+		retryCap:    cfg.L2met_RetryBackoffCap,
+		retryBudget: newRetryBudget(float64(cfg.L2met_Concurrency*cfg.L2met_OutletRetries), 0.1),
+
+		done: make(chan struct{}),
 	}
 	return l
 }
 
+// Name identifies this outlet in logs and metrics.
+func (l *DataDogOutlet) Name() string { return "datadog" }
+
+// EnableFaultInjection swaps the real DataDog transport for one that
+// simulates connection errors, 5xx/429 responses, slow responses, and
+// black holes per cfg, so retry/backoff and rate limiting can be
+// exercised against adverse conditions on demand. It must be called
+// after Mchan is set and before Start, and is meant for test/staging
+// use only.
+func (l *DataDogOutlet) EnableFaultInjection(cfg faultinject.Config) *faultinject.Transport {
+	tr := faultinject.NewTransport(l.conn.Transport, l.Mchan, cfg)
+	l.conn.Transport = tr
+	return tr
+}
+
+// Stop signals Consume's forwarding goroutine to exit. It does not
+// drain or close l.inbox itself, since the reader-driven Start() path
+// still owns that channel.
+func (l *DataDogOutlet) Stop() {
+	close(l.done)
+}
+
+// Wait blocks until every post handed to postWithRetry has finished,
+// so a caller shutting down the process doesn't abandon in-flight
+// DataDog submissions mid-retry.
+func (l *DataDogOutlet) Wait() {
+	l.inFlight.Wait()
+}
+
+// Consume wires an externally-produced bucket stream into this outlet,
+// satisfying the Outlet interface for callers that don't use the
+// reader-driven Start() path.
+func (l *DataDogOutlet) Consume(in <-chan *bucket.Bucket) {
+	go func() {
+		for {
+			select {
+			case b, ok := <-in:
+				if !ok {
+					return
+				}
+				l.inbox <- b
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
 func (l *DataDogOutlet) Start() {
-	go l.rdr.Start(l.inbox)
+	// rdr is nil for outlets that are fed via Consume instead (e.g. one
+	// of several Outlets sharing a fanned-out bucket stream); starting
+	// it unconditionally would either double-feed l.inbox from two
+	// sources or panic on a nil reader.
+	if l.rdr != nil {
+		go l.rdr.Start(l.inbox)
+	}
 	// Converting is CPU bound as it reads from memory
 	// then computes statistical functions over an array.
 	for i := 0; i < runtime.NumCPU(); i++ {
@@ -74,6 +219,55 @@ func (l *DataDogOutlet) Start() {
 		go l.outlet()
 	}
 	go l.Report()
+	go l.sweepIdleLimiters()
+}
+
+// limiterFor lazily creates the per-api_key limiter, rejecting keys we
+// haven't seen before once the new-key limiter is exhausted so an
+// attacker can't allocate unbounded limiters by forging auth headers.
+func (l *DataDogOutlet) limiterFor(apiKey string) (*rate.Limiter, bool) {
+	l.keyLimiterMu.RLock()
+	entry, present := l.keyLimiters[apiKey]
+	l.keyLimiterMu.RUnlock()
+	if present {
+		l.keyLimiterMu.Lock()
+		entry.lastUsed = time.Now()
+		l.keyLimiterMu.Unlock()
+		return entry.limiter, true
+	}
+
+	if !l.newKeyLimiter.Allow() {
+		return nil, false
+	}
+
+	l.keyLimiterMu.Lock()
+	defer l.keyLimiterMu.Unlock()
+	if entry, present = l.keyLimiters[apiKey]; present {
+		entry.lastUsed = time.Now()
+		return entry.limiter, true
+	}
+	entry = &rateLimiterEntry{
+		limiter:  rate.NewLimiter(rate.Every(l.keyInterval), l.keyBurst),
+		lastUsed: time.Now(),
+	}
+	l.keyLimiters[apiKey] = entry
+	return entry.limiter, true
+}
+
+// sweepIdleLimiters evicts per-key limiters that haven't been used in
+// a while so memory doesn't grow unbounded with the number of keys
+// ever seen.
+func (l *DataDogOutlet) sweepIdleLimiters() {
+	for range time.Tick(l.keyLimiterIdleTtl) {
+		cutoff := time.Now().Add(-l.keyLimiterIdleTtl)
+		l.keyLimiterMu.Lock()
+		for k, entry := range l.keyLimiters {
+			if entry.lastUsed.Before(cutoff) {
+				delete(l.keyLimiters, k)
+			}
+		}
+		l.keyLimiterMu.Unlock()
+	}
 }
 
 func (l *DataDogOutlet) convert() {
@@ -90,33 +284,24 @@ func (l *DataDogOutlet) convert() {
 	}
 }
 
+// groupByUser batches conversions by api_key on top of the same
+// ticker+map grouping every HTTP outlet shares (see httpbatch.Batch),
+// so a fix to the grouping logic doesn't have to land in both places.
 func (l *DataDogOutlet) groupByUser() {
-	ticker := time.Tick(time.Millisecond * 200)
-	m := make(map[string][]*metrics.DataDog)
-	for {
-		select {
-		case <-ticker:
-			for k, v := range m {
-				if len(v) > 0 {
-					l.outbox <- v
-				}
-				delete(m, k)
-			}
-		case payload := <-l.conversions:
-			log.Printf("payload: %v\n", payload)
-			usr := payload.Auth
-			if _, present := m[usr]; !present {
-				m[usr] = make([]*metrics.DataDog, 1, 300)
-				m[usr][0] = payload
-			} else {
-				m[usr] = append(m[usr], payload)
-			}
-			if len(m[usr]) == cap(m[usr]) {
-				l.outbox <- m[usr]
-				delete(m, usr)
-			}
+	in := make(chan httpbatch.Payload, cap(l.conversions))
+	go func() {
+		for payload := range l.conversions {
+			in <- payload
 		}
-	}
+		close(in)
+	}()
+	httpbatch.Batch(in, time.Millisecond*200, 300, func(_ string, batch []httpbatch.Payload) {
+		payloads := make([]*metrics.DataDog, len(batch))
+		for i, p := range batch {
+			payloads[i] = p.(*metrics.DataDog)
+		}
+		l.outbox <- payloads
+	})
 }
 
 func (l *DataDogOutlet) outlet() {
@@ -152,30 +337,52 @@ func (l *DataDogOutlet) outlet() {
 			continue
 		}
 
+		limiter, ok := l.limiterFor(api_key)
+		if !ok {
+			l.Mchan.Measure("outlet.rate-limited", 1)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.outletTtl)
+		err = limiter.Wait(ctx)
+		if err == nil {
+			err = l.globalLimiter.Wait(ctx)
+		}
+		cancel()
+		if err != nil {
+			l.Mchan.Measure("outlet.rate-limited", 1)
+			continue
+		}
+
+		l.inFlight.Add(1)
 		if err := l.postWithRetry(api_key, j); err != nil {
 			l.Mchan.Measure("outlet.drop", 1)
 		}
+		l.inFlight.Done()
 	}
 }
 
+// postWithRetry sends body using the same exponential-backoff-plus-jitter
+// loop every HTTP outlet shares (see httpbatch.PostWithBackoff), gating
+// retries on a shared, adaptive budget rather than a fixed per-request
+// counter so that when DataDog is broadly down we give up quickly
+// instead of amplifying the outage.
 func (l *DataDogOutlet) postWithRetry(api_key string, body []byte) error {
-	for i := 0; i <= l.numRetries; i++ {
-		if err := l.post(api_key, body); err != nil {
-			if !l.quiet {
-				log.Printf("measure.datadog.error key=%s msg=%s attempt=%d\n", api_key, err, i)
-			}
-			if i == l.numRetries {
-				return err
-			}
-			continue
-		}
-		return nil
+	err := httpbatch.PostWithBackoff(l.numRetries, l.retryBase, l.retryCap, l.Mchan, l.retryBudget.take, func() (int, time.Duration, error) {
+		return l.post(api_key, body)
+	})
+	if err == nil {
+		l.retryBudget.recordSuccess()
+	} else if !l.quiet {
+		log.Printf("measure.datadog.error key=%s msg=%s\n", api_key, err)
 	}
-	//Should not be possible.
-	return errors.New("Unable to post.")
+	return err
 }
 
-func (l *DataDogOutlet) post(api_key string, body []byte) error {
+// post performs a single attempt. It returns the HTTP status code (0 if
+// the request never got a response) and, if the server asked us to
+// back off via a Retry-After header, how long to wait before retrying.
+func (l *DataDogOutlet) post(api_key string, body []byte) (int, time.Duration, error) {
 	defer l.Mchan.Time("outlet.post", time.Now())
 	if l.verbose {
 		log.Printf("body: %s\n", string(body))
@@ -183,10 +390,14 @@ func (l *DataDogOutlet) post(api_key string, body []byte) error {
 	req, err := metrics.DataDogCreateRequest(metrics.DataDogUrl, api_key, body)
 	resp, err := l.conn.Do(req)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	defer resp.Body.Close()
-	return metrics.DataDogHandleResponse(resp, body)
+	retryAfter := httpbatch.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	if err := metrics.DataDogHandleResponse(resp, body); err != nil {
+		return resp.StatusCode, retryAfter, err
+	}
+	return resp.StatusCode, 0, nil
 }
 
 // Keep an eye on the lenghts of our buffers.
@@ -0,0 +1,147 @@
+package outlet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/winkapp/log-shuttle/l2met/metchan"
+	"github.com/winkapp/log-shuttle/l2met/metrics"
+	"github.com/winkapp/log-shuttle/l2met/outlet/faultinject"
+	"golang.org/x/time/rate"
+)
+
+// newTestDataDogOutlet builds a DataDogOutlet directly rather than
+// through NewDataDogOutlet, since the tests below only care about a
+// handful of fields and want tight, test-only timings rather than a
+// full shuttle.Config.
+func newTestDataDogOutlet(client *http.Client) *DataDogOutlet {
+	return &DataDogOutlet{
+		conn:              client,
+		outbox:            make(chan []*metrics.DataDog, 10),
+		numRetries:        2,
+		Mchan:             &metchan.Channel{},
+		quiet:             true,
+		outletTtl:         time.Second,
+		keyLimiters:       make(map[string]*rateLimiterEntry),
+		keyInterval:       time.Millisecond,
+		keyBurst:          1,
+		newKeyLimiter:     rate.NewLimiter(rate.Every(time.Hour), 1),
+		globalLimiter:     rate.NewLimiter(rate.Every(time.Millisecond), 10),
+		keyLimiterIdleTtl: time.Minute,
+		retryBase:         time.Millisecond,
+		retryCap:          10 * time.Millisecond,
+		retryBudget:       newRetryBudget(10, 0.1),
+		done:              make(chan struct{}),
+	}
+}
+
+func TestDataDogOutletPostWithRetry(t *testing.T) {
+	cases := []struct {
+		name     string
+		faultCfg faultinject.Config
+		wantErr  bool
+	}{
+		{
+			name:     "persistent 500 gives up cleanly after exhausting retries",
+			faultCfg: faultinject.Config{Status500Prob: 1},
+			wantErr:  true,
+		},
+		{
+			name:     "healthy backend succeeds",
+			faultCfg: faultinject.Config{},
+			wantErr:  false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			l := newTestDataDogOutlet(&http.Client{Transport: http.DefaultTransport})
+			l.EnableFaultInjection(c.faultCfg)
+			origURL := metrics.DataDogUrl
+			metrics.DataDogUrl = srv.URL
+			defer func() { metrics.DataDogUrl = origURL }()
+
+			err := l.postWithRetry("test-key", []byte(`{}`))
+			if c.wantErr && err == nil {
+				t.Fatalf("expected postWithRetry to give up and return an error, got nil")
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("expected postWithRetry to succeed, got %s", err)
+			}
+		})
+	}
+}
+
+// TestDataDogOutletRateLimiterKicksIn confirms that once the new-key
+// limiter is exhausted, an unseen api_key is rejected rather than
+// silently allocating another per-key limiter.
+func TestDataDogOutletRateLimiterKicksIn(t *testing.T) {
+	l := newTestDataDogOutlet(&http.Client{})
+	l.newKeyLimiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+
+	if _, ok := l.limiterFor("key-a"); !ok {
+		t.Fatalf("expected first unseen key to be allowed")
+	}
+	if _, ok := l.limiterFor("key-b"); ok {
+		t.Fatalf("expected second unseen key to be rejected once the new-key limiter is exhausted")
+	}
+
+	// A key we've already seen keeps using its existing limiter and
+	// isn't subject to the new-key limiter at all.
+	if _, ok := l.limiterFor("key-a"); !ok {
+		t.Fatalf("expected an already-seen key to keep working")
+	}
+}
+
+// TestDataDogOutletInFlightDrains sends a batch of payloads through
+// outlet() against an httptest.Server and verifies Wait() returns once
+// every post has finished, rather than hanging or returning early
+// while a post is still outstanding.
+func TestDataDogOutletInFlightDrains(t *testing.T) {
+	var handled int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&handled, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	origURL := metrics.DataDogUrl
+	metrics.DataDogUrl = srv.URL
+	defer func() { metrics.DataDogUrl = origURL }()
+
+	l := newTestDataDogOutlet(&http.Client{})
+	l.keyBurst = 100
+	l.globalLimiter = rate.NewLimiter(rate.Every(time.Microsecond), 100)
+
+	const batches = 5
+	for i := 0; i < batches; i++ {
+		l.outbox <- []*metrics.DataDog{{Auth: "test-key"}}
+	}
+	close(l.outbox)
+
+	go l.outlet()
+
+	done := make(chan struct{})
+	go func() {
+		l.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Wait() did not return after outlet() drained the outbox")
+	}
+
+	if got := atomic.LoadInt32(&handled); got != batches {
+		t.Fatalf("expected %d posts to reach the backend, got %d", batches, got)
+	}
+}
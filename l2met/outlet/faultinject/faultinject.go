@@ -0,0 +1,122 @@
+// Package faultinject wraps an http.Client's transport so outlet
+// resilience (retry/backoff, rate limiting) can be exercised against
+// simulated DataDog/Prometheus/Influx failures without a real
+// dependency flaking.
+package faultinject
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/winkapp/log-shuttle/l2met/metchan"
+)
+
+// Config tunes the fault rates. It's read atomically by the
+// transport, so an admin endpoint can adjust probabilities at runtime
+// without restarting the outlet.
+type Config struct {
+	// ConnErrorProb is the probability (0..1) of failing before a
+	// request is ever sent, simulating a dial/connection error.
+	ConnErrorProb float64
+	// Status500Prob, Status429Prob, Status503Prob are the
+	// probabilities of returning each status instead of proxying to
+	// the real backend.
+	Status500Prob float64
+	Status429Prob float64
+	Status503Prob float64
+	// SlowProb is the probability of sleeping for a uniform random
+	// duration in [MinSlowMs, MaxSlowMs] before responding.
+	SlowProb             float64
+	MinSlowMs, MaxSlowMs int
+	// BlackHole, when true, hangs every request until the caller's
+	// context deadline (i.e. the outlet TTL) fires.
+	BlackHole bool
+}
+
+// Transport is an http.RoundTripper that injects failures per Config
+// before (optionally) delegating to Next. Config is swapped
+// atomically, so probabilities can be tuned live.
+type Transport struct {
+	Next  http.RoundTripper
+	Mchan *metchan.Channel
+	cfg   atomic.Value // Config
+}
+
+func NewTransport(next http.RoundTripper, mchan *metchan.Channel, cfg Config) *Transport {
+	t := &Transport{Next: next, Mchan: mchan}
+	t.cfg.Store(cfg)
+	return t
+}
+
+// SetConfig atomically replaces the injector's configuration. Intended
+// to be called from an admin HTTP endpoint.
+func (t *Transport) SetConfig(cfg Config) {
+	t.cfg.Store(cfg)
+}
+
+func (t *Transport) Config() Config {
+	return t.cfg.Load().(Config)
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg := t.Config()
+
+	if cfg.BlackHole {
+		t.Mchan.Measure("outlet.injected.blackhole", 1)
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+
+	if cfg.ConnErrorProb > 0 && rand.Float64() < cfg.ConnErrorProb {
+		t.Mchan.Measure("outlet.injected.error", 1)
+		return nil, errors.New("faultinject: simulated connection error")
+	}
+
+	if cfg.SlowProb > 0 && rand.Float64() < cfg.SlowProb {
+		t.Mchan.Measure("outlet.injected.slow", 1)
+		lo, hi := cfg.MinSlowMs, cfg.MaxSlowMs
+		if hi < lo {
+			hi = lo
+		}
+		d := time.Duration(lo+rand.Intn(hi-lo+1)) * time.Millisecond
+		select {
+		case <-time.After(d):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if status := t.injectedStatus(cfg); status != 0 {
+		t.Mchan.Measure("outlet.injected.status", float64(status))
+		return &http.Response{
+			StatusCode: status,
+			Status:     fmt.Sprintf("%d injected by faultinject", status),
+			Body:       http.NoBody,
+			Header:     make(http.Header),
+			Request:    req,
+		}, nil
+	}
+
+	return t.Next.RoundTrip(req)
+}
+
+// injectedStatus rolls the configured status-code probabilities in a
+// fixed order and returns the first one that hits, or 0 for "no
+// injected status, proceed to the real transport."
+func (t *Transport) injectedStatus(cfg Config) int {
+	roll := rand.Float64()
+	switch {
+	case roll < cfg.Status500Prob:
+		return http.StatusInternalServerError
+	case roll < cfg.Status500Prob+cfg.Status429Prob:
+		return http.StatusTooManyRequests
+	case roll < cfg.Status500Prob+cfg.Status429Prob+cfg.Status503Prob:
+		return http.StatusServiceUnavailable
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,31 @@
+package faultinject
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler exposes Transport's Config over HTTP so fault probabilities
+// can be tuned at runtime: GET returns the current config, POST
+// replaces it with the JSON body.
+type Handler struct {
+	Transport *Transport
+}
+
+func (h Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.Transport.Config())
+	case http.MethodPost:
+		var cfg Config
+		if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+			http.Error(w, "invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.Transport.SetConfig(cfg)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
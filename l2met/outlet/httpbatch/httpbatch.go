@@ -0,0 +1,117 @@
+// Package httpbatch holds the batching-by-tenant and
+// retry-with-backoff machinery that's common to every HTTP-based
+// outlet (DataDog, Prometheus remote-write, Influx line protocol),
+// so each one only has to own its own wire format.
+package httpbatch
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/winkapp/log-shuttle/l2met/metchan"
+)
+
+// Payload is implemented by per-request conversions so Batch can
+// group them by tenant (e.g. DataDog api_key, the bucket's Id.Auth for Influx)
+// without knowing the concrete metric type.
+type Payload interface {
+	TenantKey() string
+}
+
+// Batch groups payloads by tenant on a fixed interval (or once a
+// tenant's batch reaches maxBatch, whichever comes first) and hands
+// each batch to send. This is the same ticker+map shape
+// DataDogOutlet's groupByUser used before it was generalized here.
+func Batch(in <-chan Payload, interval time.Duration, maxBatch int, send func(tenant string, batch []Payload)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	m := make(map[string][]Payload)
+	for {
+		select {
+		case <-ticker.C:
+			for k, v := range m {
+				if len(v) > 0 {
+					send(k, v)
+				}
+				delete(m, k)
+			}
+		case p, ok := <-in:
+			if !ok {
+				return
+			}
+			key := p.TenantKey()
+			m[key] = append(m[key], p)
+			if len(m[key]) >= maxBatch {
+				send(key, m[key])
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// Retryable distinguishes transient HTTP failures (network errors,
+// 5xx, 429) from failures that will never succeed on retry (4xx other
+// than 429). status == 0 means the request never got a response.
+func Retryable(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// Backoff returns min(cap, base*2^attempt) plus up to base of random
+// jitter, so concurrent outlet goroutines don't retry in lockstep.
+func Backoff(attempt int, base, cap time.Duration) time.Duration {
+	d := base << uint(attempt)
+	if d <= 0 || d > cap {
+		d = cap
+	}
+	return d + time.Duration(rand.Int63n(int64(base)))
+}
+
+// ParseRetryAfter understands the delay-seconds form of Retry-After;
+// an empty or unparsable header yields zero, meaning "use our own
+// backoff schedule instead."
+func ParseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	return 0
+}
+
+// PostWithBackoff calls fn, retrying retryable failures with
+// exponential backoff and jitter up to attempts times, and recording
+// outlet.retry / outlet.retry-after-honored on mchan the same way
+// every HTTP outlet's retry loop used to do it independently.
+//
+// If canRetry is non-nil, it's consulted before each retry (after the
+// attempts/retryable checks): returning false stops retrying
+// immediately, records outlet.retry-budget-exhausted instead of
+// outlet.retry, and returns the triggering error. This is how callers
+// gate retries on a shared budget (see DataDogOutlet's retryBudget)
+// without duplicating this loop.
+func PostWithBackoff(attempts int, base, cap time.Duration, mchan *metchan.Channel, canRetry func() bool, fn func() (status int, retryAfter time.Duration, err error)) error {
+	for attempt := 0; ; attempt++ {
+		status, retryAfter, err := fn()
+		if err == nil {
+			return nil
+		}
+		if !Retryable(status) || attempt >= attempts {
+			return err
+		}
+		if canRetry != nil && !canRetry() {
+			mchan.Measure("outlet.retry-budget-exhausted", 1)
+			return err
+		}
+		mchan.Measure("outlet.retry", 1)
+		sleep := retryAfter
+		if sleep <= 0 {
+			sleep = Backoff(attempt, base, cap)
+		} else {
+			mchan.Measure("outlet.retry-after-honored", 1)
+		}
+		time.Sleep(sleep)
+	}
+}
@@ -0,0 +1,154 @@
+package outlet
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/winkapp/log-shuttle"
+	"github.com/winkapp/log-shuttle/l2met/bucket"
+	"github.com/winkapp/log-shuttle/l2met/metchan"
+	"github.com/winkapp/log-shuttle/l2met/outlet/httpbatch"
+)
+
+// InfluxLineProtocolOutlet fans buckets out to an InfluxDB /api/v2/write
+// endpoint using line protocol, batching lines per tenant (the bucket's
+// Id.Auth) the same way DataDogOutlet batches per api_key.
+type InfluxLineProtocolOutlet struct {
+	url        string
+	token      string
+	conn       *http.Client
+	conversion chan httpbatch.Payload
+	inbox      chan *bucket.Bucket
+	Mchan      *metchan.Channel
+	numOutlets int
+	numRetries int
+	retryBase  time.Duration
+	retryCap   time.Duration
+	batchSize  int
+	interval   time.Duration
+	done       chan struct{}
+}
+
+// influxPoint is a single bucket converted to line-protocol form,
+// keyed by the bucket's Id.Auth for batching.
+type influxPoint struct {
+	tenant string
+	line   string
+}
+
+func (p influxPoint) TenantKey() string { return p.tenant }
+
+func NewInfluxLineProtocolOutlet(cfg shuttle.Config, m *metchan.Channel) *InfluxLineProtocolOutlet {
+	return &InfluxLineProtocolOutlet{
+		url:        cfg.L2met_InfluxUrl,
+		token:      cfg.L2met_InfluxToken,
+		conn:       &http.Client{Timeout: cfg.L2met_OutletTtl},
+		conversion: make(chan httpbatch.Payload, cfg.L2met_BufferSize),
+		inbox:      make(chan *bucket.Bucket, cfg.L2met_BufferSize),
+		Mchan:      m,
+		numOutlets: cfg.L2met_Concurrency,
+		numRetries: cfg.L2met_OutletRetries,
+		retryBase:  cfg.L2met_RetryBackoffBase,
+		retryCap:   cfg.L2met_RetryBackoffCap,
+		batchSize:  cfg.L2met_InfluxBatchSize,
+		interval:   cfg.L2met_InfluxFlushInterval,
+		done:       make(chan struct{}),
+	}
+}
+
+func (i *InfluxLineProtocolOutlet) Name() string { return "influx" }
+
+func (i *InfluxLineProtocolOutlet) Consume(in <-chan *bucket.Bucket) {
+	go func() {
+		for {
+			select {
+			case b, ok := <-in:
+				if !ok {
+					return
+				}
+				i.inbox <- b
+			case <-i.done:
+				return
+			}
+		}
+	}()
+}
+
+func (i *InfluxLineProtocolOutlet) Start() {
+	go i.convert()
+	httpbatchIn := make(chan httpbatch.Payload, cap(i.conversion))
+	go func() {
+		for p := range i.conversion {
+			httpbatchIn <- p
+		}
+		close(httpbatchIn)
+	}()
+	go httpbatch.Batch(httpbatchIn, i.interval, i.batchSize, i.send)
+}
+
+func (i *InfluxLineProtocolOutlet) Stop() {
+	close(i.done)
+}
+
+func (i *InfluxLineProtocolOutlet) convert() {
+	for b := range i.inbox {
+		i.conversion <- influxPoint{
+			tenant: b.Id.Auth,
+			line:   lineProtocol(b),
+		}
+	}
+}
+
+// lineProtocol renders a bucket as InfluxDB line protocol:
+// measurement,tag0=a,tag1=b sum=1.200000,count=3 1234567890
+func lineProtocol(b *bucket.Bucket) string {
+	var tags strings.Builder
+	for n, tag := range strings.Split(b.Id.Tags, ",") {
+		if tag == "" {
+			continue
+		}
+		fmt.Fprintf(&tags, ",tag%d=%s", n, tag)
+	}
+	return fmt.Sprintf("%s%s sum=%f,count=%d %d",
+		b.Id.Name, tags.String(), b.Sum, b.Count, b.Id.Time.UnixNano())
+}
+
+func (i *InfluxLineProtocolOutlet) send(tenant string, batch []httpbatch.Payload) {
+	var body bytes.Buffer
+	for _, p := range batch {
+		body.WriteString(p.(influxPoint).line)
+		body.WriteByte('\n')
+	}
+
+	err := httpbatch.PostWithBackoff(i.numRetries, i.retryBase, i.retryCap, i.Mchan, nil, func() (int, time.Duration, error) {
+		return i.post(body.Bytes())
+	})
+	if err != nil {
+		i.Mchan.Measure("outlet.drop", 1)
+	}
+}
+
+func (i *InfluxLineProtocolOutlet) post(body []byte) (int, time.Duration, error) {
+	req, err := http.NewRequest("POST", i.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Authorization", "Token "+i.token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	defer i.Mchan.Time("outlet.post", time.Now())
+	resp, err := i.conn.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	retryAfter := httpbatch.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, retryAfter, fmt.Errorf("influx write: status=%d", resp.StatusCode)
+	}
+	return resp.StatusCode, 0, nil
+}
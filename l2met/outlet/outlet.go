@@ -0,0 +1,22 @@
+package outlet
+
+import "github.com/winkapp/log-shuttle/l2met/bucket"
+
+// Outlet is implemented by every backend log-shuttle can fan metrics
+// out to. A single process may run several outlets over the same
+// bucket stream (see shuttle.Config.Outlets), each with its own
+// concurrency and TTL.
+type Outlet interface {
+	// Start spins up whatever background goroutines the outlet needs
+	// to drain buckets handed to it via Consume.
+	Start()
+	// Stop signals those goroutines to exit. It does not block until
+	// they have; callers that need that should use their own
+	// WaitGroup around Consume's source channel.
+	Stop()
+	// Consume wires buckets in to this outlet. Outlets read from in
+	// until it's closed or Stop is called, whichever comes first.
+	Consume(in <-chan *bucket.Bucket)
+	// Name identifies the outlet in logs and metrics, e.g. "datadog".
+	Name() string
+}
@@ -0,0 +1,149 @@
+package outlet
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/winkapp/log-shuttle"
+	"github.com/winkapp/log-shuttle/l2met/bucket"
+	"github.com/winkapp/log-shuttle/l2met/metchan"
+	"github.com/winkapp/log-shuttle/l2met/outlet/httpbatch"
+)
+
+// PrometheusRemoteWriteOutlet fans buckets out to a Prometheus
+// remote_write endpoint as snappy-compressed protobuf.
+type PrometheusRemoteWriteOutlet struct {
+	url        string
+	conn       *http.Client
+	inbox      chan *bucket.Bucket
+	Mchan      *metchan.Channel
+	numOutlets int
+	numRetries int
+	retryBase  time.Duration
+	retryCap   time.Duration
+	done       chan struct{}
+}
+
+func NewPrometheusRemoteWriteOutlet(cfg shuttle.Config, m *metchan.Channel) *PrometheusRemoteWriteOutlet {
+	return &PrometheusRemoteWriteOutlet{
+		url:        cfg.L2met_PrometheusRemoteWriteUrl,
+		conn:       &http.Client{Timeout: cfg.L2met_OutletTtl},
+		inbox:      make(chan *bucket.Bucket, cfg.L2met_BufferSize),
+		Mchan:      m,
+		numOutlets: cfg.L2met_Concurrency,
+		numRetries: cfg.L2met_OutletRetries,
+		retryBase:  cfg.L2met_RetryBackoffBase,
+		retryCap:   cfg.L2met_RetryBackoffCap,
+		done:       make(chan struct{}),
+	}
+}
+
+func (p *PrometheusRemoteWriteOutlet) Name() string { return "prometheus-remote-write" }
+
+func (p *PrometheusRemoteWriteOutlet) Consume(in <-chan *bucket.Bucket) {
+	go func() {
+		for {
+			select {
+			case b, ok := <-in:
+				if !ok {
+					return
+				}
+				p.inbox <- b
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+func (p *PrometheusRemoteWriteOutlet) Start() {
+	for i := 0; i < p.numOutlets; i++ {
+		go p.outlet()
+	}
+}
+
+func (p *PrometheusRemoteWriteOutlet) Stop() {
+	close(p.done)
+}
+
+func (p *PrometheusRemoteWriteOutlet) outlet() {
+	for b := range p.inbox {
+		series := bucketToTimeSeries(b)
+		if len(series) == 0 {
+			continue
+		}
+		req := &prompb.WriteRequest{Timeseries: series}
+		data, err := proto.Marshal(req)
+		if err != nil {
+			p.Mchan.Measure("outlet.drop", 1)
+			continue
+		}
+		compressed := snappy.Encode(nil, data)
+
+		err = httpbatch.PostWithBackoff(p.numRetries, p.retryBase, p.retryCap, p.Mchan, nil, func() (int, time.Duration, error) {
+			return p.post(compressed)
+		})
+		if err != nil {
+			p.Mchan.Measure("outlet.drop", 1)
+		}
+	}
+}
+
+func (p *PrometheusRemoteWriteOutlet) post(body []byte) (int, time.Duration, error) {
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	defer p.Mchan.Time("outlet.post", time.Now())
+	resp, err := p.conn.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	retryAfter := httpbatch.ParseRetryAfter(resp.Header.Get("Retry-After"))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, retryAfter, fmt.Errorf("prometheus remote-write: status=%d", resp.StatusCode)
+	}
+	return resp.StatusCode, 0, nil
+}
+
+// bucketToTimeSeries expands a bucket into one prompb.TimeSeries per
+// aggregate we track (sum, count), carrying Id.Tags and Id.Source
+// through as labels.
+func bucketToTimeSeries(b *bucket.Bucket) []prompb.TimeSeries {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: b.Id.Name},
+		{Name: "source", Value: b.Id.Source},
+	}
+	for _, tag := range strings.Split(b.Id.Tags, ",") {
+		if tag == "" {
+			continue
+		}
+		labels = append(labels, prompb.Label{Name: "tag", Value: tag})
+	}
+
+	ts := b.Id.Time.UnixNano() / int64(time.Millisecond)
+	withSuffix := func(suffix string) []prompb.Label {
+		out := make([]prompb.Label, len(labels))
+		copy(out, labels)
+		out[0] = prompb.Label{Name: "__name__", Value: b.Id.Name + suffix}
+		return out
+	}
+
+	return []prompb.TimeSeries{
+		{Labels: withSuffix("_sum"), Samples: []prompb.Sample{{Value: b.Sum, Timestamp: ts}}},
+		{Labels: withSuffix("_count"), Samples: []prompb.Sample{{Value: float64(b.Count), Timestamp: ts}}},
+	}
+}
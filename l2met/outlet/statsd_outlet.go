@@ -0,0 +1,117 @@
+package outlet
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/winkapp/log-shuttle"
+	"github.com/winkapp/log-shuttle/l2met/bucket"
+	"github.com/winkapp/log-shuttle/l2met/metchan"
+)
+
+// StatsDOutlet fans buckets out to a DogStatsD-compatible collector
+// over UDP, batching lines up to the configured MTU rather than
+// sending one datagram per metric.
+type StatsDOutlet struct {
+	addr          string
+	conn          net.Conn
+	inbox         chan *bucket.Bucket
+	Mchan         *metchan.Channel
+	numOutlets    int
+	mtu           int
+	flushInterval time.Duration
+	done          chan struct{}
+}
+
+func NewStatsDOutlet(cfg shuttle.Config, m *metchan.Channel) (*StatsDOutlet, error) {
+	conn, err := net.Dial("udp", cfg.L2met_StatsDAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDOutlet{
+		addr:          cfg.L2met_StatsDAddr,
+		conn:          conn,
+		inbox:         make(chan *bucket.Bucket, cfg.L2met_BufferSize),
+		Mchan:         m,
+		numOutlets:    cfg.L2met_Concurrency,
+		mtu:           cfg.L2met_StatsDMtu,
+		flushInterval: cfg.L2met_StatsDFlushInterval,
+		done:          make(chan struct{}),
+	}, nil
+}
+
+func (s *StatsDOutlet) Name() string { return "statsd" }
+
+func (s *StatsDOutlet) Consume(in <-chan *bucket.Bucket) {
+	go func() {
+		for {
+			select {
+			case b, ok := <-in:
+				if !ok {
+					return
+				}
+				s.inbox <- b
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+func (s *StatsDOutlet) Start() {
+	for i := 0; i < s.numOutlets; i++ {
+		go s.outlet()
+	}
+}
+
+func (s *StatsDOutlet) Stop() {
+	close(s.done)
+}
+
+func (s *StatsDOutlet) outlet() {
+	var buf bytes.Buffer
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write(buf.Bytes()); err != nil {
+			s.Mchan.Measure("outlet.drop", 1)
+		}
+		buf.Reset()
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			flush()
+		case b, ok := <-s.inbox:
+			if !ok {
+				flush()
+				return
+			}
+			line := statsDLine(b)
+			if buf.Len()+len(line) > s.mtu {
+				flush()
+			}
+			buf.WriteString(line)
+		case <-s.done:
+			flush()
+			return
+		}
+	}
+}
+
+// statsDLine renders a bucket as a DogStatsD gauge line:
+// metric.name:value|g|#tag1,tag2
+func statsDLine(b *bucket.Bucket) string {
+	tagSuffix := ""
+	if b.Id.Tags != "" {
+		tagSuffix = "|#" + b.Id.Tags
+	}
+	return fmt.Sprintf("%s:%f|g%s\n", b.Id.Name, b.Sum, tagSuffix)
+}
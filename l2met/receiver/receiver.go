@@ -61,6 +61,19 @@ type Receiver struct {
     // Publish receiver metrics on this channel.
     Mchan           *metchan.Channel
     inFlight        sync.WaitGroup
+    // Live-tail subscribers (see subscriber.go). Publishing to these
+    // is best-effort and must never block transfer().
+    Subscribers     *Subscribers
+
+    // Optional write-ahead log (see wal.go) so buckets accepted since
+    // the last FlushInterval survive a crash. Nil when disabled.
+    wal             *registerWAL
+    // WAL indices that contributed to a given in-register bucket,
+    // written under Register.Lock() alongside the merge they describe.
+    bucketIndices   map[*bucket.Bucket][]uint64
+    // Indices handed off to Outbox but not yet durably stored, looked
+    // up by outlet() once Store.Put succeeds.
+    pendingIndices  sync.Map
 }
 
 func NewReceiver(buffsize int, flushInt time.Duration, ccu int, rcvrd int64, s store.Store, m *metchan.Channel) *Receiver {
@@ -75,9 +88,58 @@ func NewReceiver(buffsize int, flushInt time.Duration, ccu int, rcvrd int64, s s
     r.numReqs = uint64(0)
     r.Store = s
     r.Mchan = m
+    r.Subscribers = newSubscribers()
+    r.bucketIndices = make(map[*bucket.Bucket][]uint64)
     return r
 }
 
+// NewReceiverWithWAL is NewReceiver plus an optional write-ahead log.
+// walPath empty disables the WAL entirely, in which case behavior is
+// identical to NewReceiver. When enabled, every entry still in the log
+// (not yet truncated after a committed Store.Put) is replayed into the
+// register so it isn't lost across a crash or SIGKILL. Entries that
+// were committed but not yet truncated are replayed as well.
+func NewReceiverWithWAL(buffsize int, flushInt time.Duration, ccu int, rcvrd int64, s store.Store, m *metchan.Channel, walPath string, walSyncEvery int, walSyncInterval time.Duration) (*Receiver, error) {
+    r := NewReceiver(buffsize, flushInt, ccu, rcvrd, s, m)
+    if walPath == "" {
+        return r, nil
+    }
+    w, err := openRegisterWAL(walPath, walSyncEvery, walSyncInterval)
+    if err != nil {
+        return nil, err
+    }
+    r.wal = w
+    if err := w.replay(func(b *bucket.Bucket, index uint64) {
+        r.restoreRegister(b, index)
+    }); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+// restoreRegister repopulates the in-memory register from a replayed
+// WAL entry. Unlike addRegister, it doesn't write back to the WAL
+// (we're replaying it). It adds to inFlight once per new register
+// entry, since outlet() calls inFlight.Done() for every bucket it
+// takes from Outbox, replayed ones included.
+// It still records index against the (possibly merged-into) register
+// bucket, so the normal transfer()/outlet() path can mark it committed
+// once Store.Put actually succeeds for it again after the restart.
+func (r *Receiver) restoreRegister(b *bucket.Bucket, index uint64) {
+    r.Register.Lock()
+    defer r.Register.Unlock()
+    k := *b.Id
+    existing, present := r.Register.m[k]
+    if !present {
+        r.inFlight.Add(1)
+        r.Register.m[k] = b
+        existing = b
+    } else {
+        existing.Merge(b)
+    }
+    r.bucketIndices[existing] = append(r.bucketIndices[existing], index)
+}
+
 func (r *Receiver) Receive(b []byte, opts map[string][]string) {
     logger.Debugf("Received: body: %q - opts: %+v", string(b), opts)
     r.inFlight.Add(1)
@@ -105,6 +167,9 @@ func (r *Receiver) Start() {
     // It removes buckets from the register to the outbox.
     go r.scheduleTransfer()
     go r.Report()
+    if r.wal != nil {
+        go r.truncateWAL()
+    }
 }
 
 // This function can be used as
@@ -154,13 +219,22 @@ func (r *Receiver) addRegister(b *bucket.Bucket) {
     defer r.Register.Unlock()
     atomic.AddUint64(&r.numBuckets, 1)
     k := *b.Id
-    _, present := r.Register.m[k]
+    existing, present := r.Register.m[k]
     if !present {
         r.Mchan.Count("receiver.add-bucket", 1)
         r.Register.m[k] = b
+        existing = b
     } else {
         r.Mchan.Count("receiver.merge-bucket", 1)
-        r.Register.m[k].Merge(b)
+        existing.Merge(b)
+    }
+    if r.wal != nil {
+        index, err := r.wal.append(b)
+        if err != nil {
+            logger.Errorf("at=wal-append error=%s", err)
+        } else {
+            r.bucketIndices[existing] = append(r.bucketIndices[existing], index)
+        }
     }
 }
 
@@ -176,6 +250,13 @@ func (r *Receiver) transfer() {
     for k := range r.Register.m {
         if m, ok := r.Register.m[k]; ok {
             delete(r.Register.m, k)
+            if r.wal != nil {
+                if indices, present := r.bucketIndices[m]; present {
+                    r.pendingIndices.Store(m, indices)
+                    delete(r.bucketIndices, m)
+                }
+            }
+            r.Subscribers.publish(m)
             r.Outbox <- m
         }
     }
@@ -198,12 +279,29 @@ func (r *Receiver) outlet() {
         //logger.Debugf("    Tags:        %s", b.Id.Tags)
         if err := r.Store.Put(b); err != nil {
             logger.Errorf("error=%s", err)
+        } else if r.wal != nil {
+            if v, ok := r.pendingIndices.Load(b); ok {
+                for _, index := range v.([]uint64) {
+                    r.wal.markCommitted(index)
+                }
+                r.pendingIndices.Delete(b)
+            }
         }
         r.Mchan.Time("receiver.outlet", startPut)
         r.inFlight.Done()
     }
 }
 
+// truncateWAL periodically drops WAL entries that have been durably
+// stored, so the log doesn't grow without bound.
+func (r *Receiver) truncateWAL() {
+    for range time.Tick(r.FlushInterval) {
+        if err := r.wal.truncate(); err != nil {
+            logger.Errorf("at=wal-truncate error=%s", err)
+        }
+    }
+}
+
 //func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 //    atomic.AddUint64(&r.numReqs, 1)
 //    defer r.Mchan.Time("http.accept", time.Now())
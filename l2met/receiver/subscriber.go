@@ -0,0 +1,228 @@
+package receiver
+
+import (
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/winkapp/log-shuttle/l2met/bucket"
+)
+
+const (
+    subscriberSendBuffer = 100000
+
+    subscriberPingPeriod = 54 * time.Second
+    subscriberPongWait   = 60 * time.Second
+)
+
+var subscriberUpgrader = websocket.Upgrader{
+    ReadBufferSize:  1024,
+    WriteBufferSize: 1024,
+    // Live-tail is an operator tool; cross-origin admin access is
+    // expected when dashboards proxy through a browser.
+    CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// subscriberFilter is compiled once at subscribe time so the hot path
+// (publish) only ever does cheap field comparisons.
+type subscriberFilter struct {
+    auth         string
+    namePattern  *regexp.Regexp
+    source       string
+    minResolution time.Duration
+}
+
+func newSubscriberFilter(q map[string][]string) (*subscriberFilter, error) {
+    f := &subscriberFilter{}
+    if v := first(q, "auth"); v != "" {
+        f.auth = v
+    }
+    if v := first(q, "name"); v != "" {
+        pattern, err := globToRegexp(v)
+        if err != nil {
+            return nil, err
+        }
+        f.namePattern = pattern
+    }
+    if v := first(q, "source"); v != "" {
+        f.source = v
+    }
+    if v := first(q, "min_resolution"); v != "" {
+        secs, err := strconv.Atoi(v)
+        if err != nil {
+            return nil, err
+        }
+        f.minResolution = time.Duration(secs) * time.Second
+    }
+    return f, nil
+}
+
+func first(q map[string][]string, key string) string {
+    if v, present := q[key]; present && len(v) > 0 {
+        return v[0]
+    }
+    return ""
+}
+
+// globToRegexp turns a shell-style glob (router.*) into an anchored
+// regexp so matching a bucket name is a single cheap call.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+    escaped := regexp.QuoteMeta(glob)
+    escaped = strings.Replace(escaped, `\*`, `.*`, -1)
+    return regexp.Compile("^" + escaped + "$")
+}
+
+// matches is called once per bucket on the publisher's goroutine, so it
+// must stay cheap: field comparisons only, no allocation on the common
+// path.
+func (f *subscriberFilter) matches(b *bucket.Bucket) bool {
+    if f.auth != "" && !strings.HasPrefix(b.Id.Auth, f.auth) {
+        return false
+    }
+    if f.namePattern != nil && !f.namePattern.MatchString(b.Id.Name) {
+        return false
+    }
+    if f.source != "" && b.Id.Source != f.source {
+        return false
+    }
+    if f.minResolution != 0 && b.Id.Resolution < f.minResolution {
+        return false
+    }
+    return true
+}
+
+// subscriber live-tails buckets as they flow through the receiver. It
+// is intentionally decoupled from the primary outlet path: a slow or
+// dead consumer can only ever drop its own events, never stall
+// transfer() or outlet().
+type subscriber struct {
+    conn   *websocket.Conn
+    filter *subscriberFilter
+    send   chan *bucket.Bucket
+    mchan  mchanCounter
+}
+
+// mchanCounter is the subset of metchan.Channel the subscriber needs;
+// declared locally so this file doesn't have to import metchan just
+// for a Count call.
+type mchanCounter interface {
+    Count(string, float64)
+}
+
+// Subscribers tracks the live set of WebSocket tailers and publishes
+// buckets to the ones whose filters match.
+type Subscribers struct {
+    mu   sync.RWMutex
+    subs map[*subscriber]struct{}
+}
+
+func newSubscribers() *Subscribers {
+    return &Subscribers{subs: make(map[*subscriber]struct{})}
+}
+
+func (s *Subscribers) add(sub *subscriber) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.subs[sub] = struct{}{}
+}
+
+func (s *Subscribers) remove(sub *subscriber) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.subs, sub)
+}
+
+// publish fans b out to every subscriber whose filter matches. It must
+// never block: a full subscriber channel means a slow consumer, and we
+// drop for that one subscriber rather than hold up the caller.
+func (s *Subscribers) publish(b *bucket.Bucket) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    for sub := range s.subs {
+        if !sub.filter.matches(b) {
+            continue
+        }
+        select {
+        case sub.send <- b:
+        default:
+            sub.mchan.Count("receiver.subscriber.drop", 1)
+        }
+    }
+}
+
+// ServeTail upgrades the request to a WebSocket and registers the
+// connection as a subscriber until it disconnects. Filters (auth,
+// name glob, source, min_resolution) are passed as query params and
+// compiled once, up front.
+func (r *Receiver) ServeTail(w http.ResponseWriter, req *http.Request) {
+    filter, err := newSubscriberFilter(req.URL.Query())
+    if err != nil {
+        http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    conn, err := subscriberUpgrader.Upgrade(w, req, nil)
+    if err != nil {
+        logger.Errorf("at=subscriber-upgrade error=%s", err)
+        return
+    }
+    sub := &subscriber{
+        conn:   conn,
+        filter: filter,
+        send:   make(chan *bucket.Bucket, subscriberSendBuffer),
+        mchan:  r.Mchan,
+    }
+    r.Subscribers.add(sub)
+    go sub.run(r.Subscribers)
+}
+
+// run JSON-encodes and writes buckets to the WebSocket connection. All
+// of that work happens on this goroutine, never in transfer(), so a
+// slow consumer can't stall aggregation.
+func (sub *subscriber) run(subs *Subscribers) {
+    defer func() {
+        subs.remove(sub)
+        sub.conn.Close()
+    }()
+
+    sub.conn.SetReadDeadline(time.Now().Add(subscriberPongWait))
+    sub.conn.SetPongHandler(func(string) error {
+        sub.conn.SetReadDeadline(time.Now().Add(subscriberPongWait))
+        return nil
+    })
+    go sub.discardReads()
+
+    ticker := time.NewTicker(subscriberPingPeriod)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case b, ok := <-sub.send:
+            if !ok {
+                return
+            }
+            sub.conn.SetWriteDeadline(time.Now().Add(subscriberPongWait))
+            if err := sub.conn.WriteJSON(b); err != nil {
+                return
+            }
+        case <-ticker.C:
+            sub.conn.SetWriteDeadline(time.Now().Add(subscriberPongWait))
+            if err := sub.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                return
+            }
+        }
+    }
+}
+
+// discardReads drains and discards client frames so pong control
+// messages are processed and a client-initiated close is noticed.
+func (sub *subscriber) discardReads() {
+    for {
+        if _, _, err := sub.conn.NextReader(); err != nil {
+            return
+        }
+    }
+}
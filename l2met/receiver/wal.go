@@ -0,0 +1,172 @@
+package receiver
+
+import (
+    "sync"
+    "time"
+
+    "github.com/tidwall/wal"
+    "github.com/winkapp/log-shuttle/l2met/bucket"
+)
+
+// registerWAL persists every bucket appended to the in-memory register
+// before it's acknowledged, so a crash between accept() and a
+// successful Store.Put doesn't silently lose data. When disabled,
+// receiver behavior is identical to the in-memory-only path.
+type registerWAL struct {
+    log *wal.Log
+
+    mu           sync.Mutex
+    writesSinceSync int
+    syncEvery       int
+    syncInterval    time.Duration
+    lastSync        time.Time
+
+    commit commitTracker
+}
+
+func openRegisterWAL(path string, syncEvery int, syncInterval time.Duration) (*registerWAL, error) {
+    l, err := wal.Open(path, wal.DefaultOptions)
+    if err != nil {
+        return nil, err
+    }
+    return &registerWAL{
+        log:          l,
+        syncEvery:    syncEvery,
+        syncInterval: syncInterval,
+        lastSync:     time.Now(),
+    }, nil
+}
+
+// append writes b to the log and returns the index it was written at.
+// Callers must hold Register.Lock() so WAL order matches register
+// insertion order.
+func (w *registerWAL) append(b *bucket.Bucket) (uint64, error) {
+    data, err := bucket.EncodeWAL(b)
+    if err != nil {
+        return 0, err
+    }
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    last, err := w.log.LastIndex()
+    if err != nil {
+        return 0, err
+    }
+    index := last + 1
+    if err := w.log.Write(index, data); err != nil {
+        return 0, err
+    }
+    w.commit.track(index)
+    w.writesSinceSync++
+    if w.writesSinceSync >= w.syncEvery || time.Since(w.lastSync) >= w.syncInterval {
+        if err := w.log.Sync(); err != nil {
+            return index, err
+        }
+        w.writesSinceSync = 0
+        w.lastSync = time.Now()
+    }
+    return index, nil
+}
+
+// markCommitted records that the bucket written at index has been
+// durably stored (Store.Put succeeded), advancing the contiguous
+// watermark the background truncator uses.
+func (w *registerWAL) markCommitted(index uint64) {
+    w.commit.done(index)
+}
+
+// truncate drops WAL entries at or before the current committed
+// watermark, always keeping the log's last entry (the log cannot be
+// truncated to empty). Safe to call on a timer; it's a no-op when
+// nothing new has become truncation-safe.
+func (w *registerWAL) truncate() error {
+    mark := w.commit.watermark()
+    last, err := w.log.LastIndex()
+    if err != nil {
+        return err
+    }
+    if mark >= last {
+        mark = last - 1
+    }
+    if mark == 0 || last == 0 {
+        return nil
+    }
+    return w.log.TruncateFront(mark + 1)
+}
+
+// replay calls fn for every entry between the log's first index and
+// its last, in order, so the caller can repopulate the in-memory
+// register on startup. fn receives the entry's WAL index so the
+// caller can keep tracking it through to the next real Store.Put.
+func (w *registerWAL) replay(fn func(*bucket.Bucket, uint64)) error {
+    first, err := w.log.FirstIndex()
+    if err != nil {
+        return err
+    }
+    last, err := w.log.LastIndex()
+    if err != nil {
+        return err
+    }
+    // Entries before first were truncated, so they count as done;
+    // start the watermark just below first so it can advance.
+    if first > 0 {
+        w.commit.mu.Lock()
+        w.commit.mark = first - 1
+        w.commit.mu.Unlock()
+    }
+    for i := first; i != 0 && i <= last; i++ {
+        data, err := w.log.Read(i)
+        if err != nil {
+            return err
+        }
+        b, err := bucket.DecodeWAL(data)
+        if err != nil {
+            return err
+        }
+        // Replayed entries are only back in the in-memory register,
+        // not yet durably stored again: track them as pending so the
+        // watermark can't pass them until the post-restart
+        // accept->transfer->outlet pipeline reports a real Store.Put
+        // success (see markCommitted). Calling done() here would let
+        // the very next truncate drop entries a second crash, before
+        // that Put happens, would lose for good.
+        w.commit.track(i)
+        fn(b, i)
+    }
+    return nil
+}
+
+// commitTracker advances a monotonic watermark only once every index
+// up to it has been marked done, so truncation never drops an entry
+// that's still only in the register, not yet durably stored.
+type commitTracker struct {
+    mu      sync.Mutex
+    pending map[uint64]bool
+    mark    uint64
+}
+
+func (c *commitTracker) track(index uint64) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.pending == nil {
+        c.pending = make(map[uint64]bool)
+    }
+    if index > 0 {
+        c.pending[index] = false
+    }
+}
+
+func (c *commitTracker) done(index uint64) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.pending[index] = true
+    for c.pending[c.mark+1] {
+        delete(c.pending, c.mark+1)
+        c.mark++
+    }
+}
+
+func (c *commitTracker) watermark() uint64 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.mark
+}
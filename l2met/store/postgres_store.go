@@ -0,0 +1,172 @@
+package store
+
+import (
+    "database/sql"
+    "time"
+
+    _ "github.com/lib/pq"
+
+    "github.com/winkapp/log-shuttle/l2met/bucket"
+)
+
+// PostgresStore is a Store backed by a single `metrics` table, so
+// several log-shuttle instances can share one Postgres database
+// instead of each holding its own in-memory register. Rows are keyed
+// by (token, bucket_time, name, source); Put merges into an existing
+// row server-side rather than requiring a read-modify-write.
+type PostgresStore struct {
+    db *sql.DB
+}
+
+// NewPostgresStore opens db and ensures the metrics table exists.
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+    db, err := sql.Open("postgres", dsn)
+    if err != nil {
+        return nil, err
+    }
+    if err := db.Ping(); err != nil {
+        return nil, err
+    }
+    s := &PostgresStore{db: db}
+    if err := s.ensureSchema(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+func (s *PostgresStore) ensureSchema() error {
+    _, err := s.db.Exec(`
+CREATE TABLE IF NOT EXISTS metrics (
+    token       text        NOT NULL,
+    bucket_time timestamptz NOT NULL,
+    name        text        NOT NULL,
+    source      text        NOT NULL,
+    units       text        NOT NULL DEFAULT '',
+    type        text        NOT NULL DEFAULT '',
+    tags        text        NOT NULL DEFAULT '',
+    resolution  bigint      NOT NULL DEFAULT 0,
+    vals        bytea       NOT NULL DEFAULT '',
+    sum         double precision NOT NULL DEFAULT 0,
+    count       bigint      NOT NULL DEFAULT 0,
+    PRIMARY KEY (token, bucket_time, name, source)
+)`)
+    return err
+}
+
+// Put upserts b, merging Vals/Sum/Count into any existing row for the
+// same (token, bucket_time, name, source) rather than overwriting it,
+// so concurrent outlets writing the same bucket never lose data.
+// Units/Type/Tags/Resolution are part of the bucket's identity rather
+// than its accumulated values, so they're only set on insert, same as
+// the other Id fields in the PRIMARY KEY.
+func (s *PostgresStore) Put(b *bucket.Bucket) error {
+    vals, err := bucket.EncodeVals(b.Vals)
+    if err != nil {
+        return err
+    }
+    _, err = s.db.Exec(`
+INSERT INTO metrics (token, bucket_time, name, source, units, type, tags, resolution, vals, sum, count)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+ON CONFLICT (token, bucket_time, name, source) DO UPDATE SET
+    vals  = metrics.vals || EXCLUDED.vals,
+    sum   = metrics.sum + EXCLUDED.sum,
+    count = metrics.count + EXCLUDED.count
+`, b.Id.Auth, b.Id.Time, b.Id.Name, b.Id.Source, b.Id.Units, b.Id.Type, b.Id.Tags, int64(b.Id.Resolution), vals, b.Sum, b.Count)
+    return err
+}
+
+// Scan claims every bucket whose deadline has passed, locking the rows
+// with SELECT ... FOR UPDATE SKIP LOCKED so multiple log-shuttle
+// instances can scan the same table concurrently without handing the
+// same bucket to two outlets, then deletes the claimed rows.
+func (s *PostgresStore) Scan(deadline time.Duration) ([]*bucket.Bucket, error) {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.Query(`
+SELECT token, bucket_time, name, source, units, type, tags, resolution, vals, sum, count
+FROM metrics
+WHERE bucket_time <= now() - make_interval(secs => $1)
+FOR UPDATE SKIP LOCKED
+`, deadline.Seconds())
+    if err != nil {
+        return nil, err
+    }
+
+    var buckets []*bucket.Bucket
+    var claimed []struct {
+        token string
+        t     time.Time
+        name  string
+        src   string
+    }
+    for rows.Next() {
+        var (
+            token, name, src, units, typ, tags string
+            t                                  time.Time
+            resolution                         int64
+            vals                               []byte
+            sum                                float64
+            count                              int
+        )
+        if err := rows.Scan(&token, &t, &name, &src, &units, &typ, &tags, &resolution, &vals, &sum, &count); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        decoded, err := bucket.DecodeVals(vals)
+        if err != nil {
+            rows.Close()
+            return nil, err
+        }
+        buckets = append(buckets, &bucket.Bucket{
+            Id: &bucket.Id{
+                Auth:       token,
+                Time:       t,
+                Name:       name,
+                Source:     src,
+                Units:      units,
+                Type:       typ,
+                Tags:       tags,
+                Resolution: time.Duration(resolution),
+            },
+            Vals:  decoded,
+            Sum:   sum,
+            Count: count,
+        })
+        claimed = append(claimed, struct {
+            token string
+            t     time.Time
+            name  string
+            src   string
+        }{token, t, name, src})
+    }
+    if err := rows.Err(); err != nil {
+        rows.Close()
+        return nil, err
+    }
+    rows.Close()
+
+    for _, c := range claimed {
+        if _, err := tx.Exec(`
+DELETE FROM metrics WHERE token = $1 AND bucket_time = $2 AND name = $3 AND source = $4
+`, c.token, c.t, c.name, c.src); err != nil {
+            return nil, err
+        }
+    }
+
+    return buckets, tx.Commit()
+}
+
+// Now returns the database's clock rather than the local one, so a
+// fleet of log-shuttle instances agree on when a bucket's deadline has
+// passed regardless of clock drift between hosts.
+func (s *PostgresStore) Now() time.Time {
+    var t time.Time
+    if err := s.db.QueryRow(`SELECT now()`).Scan(&t); err != nil {
+        return time.Now()
+    }
+    return t
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+    "context"
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/testcontainers/testcontainers-go"
+    "github.com/testcontainers/testcontainers-go/wait"
+
+    "github.com/winkapp/log-shuttle/l2met/bucket"
+)
+
+// newTestPostgresStore starts a throwaway Postgres container and
+// returns a PostgresStore pointed at it, along with a func to tear the
+// container down. Skips the test if Docker isn't available, since this
+// is the only kind of test in the repo that needs it.
+func newTestPostgresStore(t *testing.T) (*PostgresStore, func()) {
+    t.Helper()
+    if testing.Short() {
+        t.Skip("skipping testcontainers-backed test in -short mode")
+    }
+
+    ctx := context.Background()
+    req := testcontainers.ContainerRequest{
+        Image:        "postgres:15-alpine",
+        ExposedPorts: []string{"5432/tcp"},
+        Env: map[string]string{
+            "POSTGRES_USER":     "l2met",
+            "POSTGRES_PASSWORD": "l2met",
+            "POSTGRES_DB":       "l2met",
+        },
+        WaitingFor: wait.ForListeningPort("5432/tcp").WithStartupTimeout(30 * time.Second),
+    }
+    container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+        ContainerRequest: req,
+        Started:          true,
+    })
+    if err != nil {
+        t.Skipf("skipping: could not start postgres container: %s", err)
+    }
+
+    host, err := container.Host(ctx)
+    if err != nil {
+        t.Fatalf("container host: %s", err)
+    }
+    port, err := container.MappedPort(ctx, "5432/tcp")
+    if err != nil {
+        t.Fatalf("mapped port: %s", err)
+    }
+
+    dsn := fmt.Sprintf("postgres://l2met:l2met@%s:%s/l2met?sslmode=disable", host, port.Port())
+    s, err := NewPostgresStore(dsn)
+    if err != nil {
+        container.Terminate(ctx)
+        t.Fatalf("NewPostgresStore: %s", err)
+    }
+
+    return s, func() { container.Terminate(ctx) }
+}
+
+// TestPostgresStorePutMerges checks that two Puts for the same
+// (token, bucket_time, name, source) merge their Vals/Sum/Count
+// server-side instead of one overwriting the other.
+func TestPostgresStorePutMerges(t *testing.T) {
+    s, teardown := newTestPostgresStore(t)
+    defer teardown()
+
+    bucketTime := time.Now().Truncate(time.Second)
+    id := &bucket.Id{
+        Auth:       "tenant-a",
+        Time:       bucketTime,
+        Name:       "router.latency",
+        Source:     "web.1",
+        Units:      "ms",
+        Type:       "gauge",
+        Tags:       "region:us,az:1",
+        Resolution: 20 * time.Second,
+    }
+
+    if err := s.Put(&bucket.Bucket{Id: id, Vals: []float64{1, 2}, Sum: 3, Count: 2}); err != nil {
+        t.Fatalf("first Put: %s", err)
+    }
+    if err := s.Put(&bucket.Bucket{Id: id, Vals: []float64{3, 4}, Sum: 7, Count: 2}); err != nil {
+        t.Fatalf("second Put: %s", err)
+    }
+
+    buckets, err := s.Scan(0)
+    if err != nil {
+        t.Fatalf("Scan: %s", err)
+    }
+    if len(buckets) != 1 {
+        t.Fatalf("expected the two Puts to merge into one row, got %d", len(buckets))
+    }
+
+    got := buckets[0]
+    if got.Sum != 10 {
+        t.Errorf("sum = %v, want 10", got.Sum)
+    }
+    if got.Count != 4 {
+        t.Errorf("count = %v, want 4", got.Count)
+    }
+    if len(got.Vals) != 4 {
+        t.Errorf("vals = %v, want 4 entries (both Puts' vals concatenated)", got.Vals)
+    }
+    if got.Id.Units != id.Units {
+        t.Errorf("units = %q, want %q", got.Id.Units, id.Units)
+    }
+    if got.Id.Type != id.Type {
+        t.Errorf("type = %q, want %q", got.Id.Type, id.Type)
+    }
+    if got.Id.Tags != id.Tags {
+        t.Errorf("tags = %q, want %q", got.Id.Tags, id.Tags)
+    }
+    if got.Id.Resolution != id.Resolution {
+        t.Errorf("resolution = %v, want %v", got.Id.Resolution, id.Resolution)
+    }
+}
+
+// TestPostgresStoreScanRespectsDeadline checks that Scan only claims
+// buckets whose bucket_time is at least `deadline` old, and that the
+// deadline survives the Go-duration-to-Postgres-interval conversion
+// for a sub-second value.
+func TestPostgresStoreScanRespectsDeadline(t *testing.T) {
+    s, teardown := newTestPostgresStore(t)
+    defer teardown()
+
+    old := &bucket.Id{Auth: "tenant-a", Time: time.Now().Add(-time.Hour), Name: "router.latency", Source: "web.1"}
+    recent := &bucket.Id{Auth: "tenant-a", Time: time.Now(), Name: "router.latency", Source: "web.2"}
+
+    if err := s.Put(&bucket.Bucket{Id: old, Vals: []float64{1}, Sum: 1, Count: 1}); err != nil {
+        t.Fatalf("Put old: %s", err)
+    }
+    if err := s.Put(&bucket.Bucket{Id: recent, Vals: []float64{1}, Sum: 1, Count: 1}); err != nil {
+        t.Fatalf("Put recent: %s", err)
+    }
+
+    buckets, err := s.Scan(500 * time.Millisecond)
+    if err != nil {
+        t.Fatalf("Scan: %s", err)
+    }
+    if len(buckets) != 1 || buckets[0].Id.Source != "web.1" {
+        t.Fatalf("expected only the bucket older than the deadline to be claimed, got %+v", buckets)
+    }
+}
+
+// TestPostgresStoreScanClaimsOnce checks that Scan deletes the rows it
+// claims, so concurrent instances racing against the same table via
+// FOR UPDATE SKIP LOCKED can never hand out the same bucket twice.
+func TestPostgresStoreScanClaimsOnce(t *testing.T) {
+    s, teardown := newTestPostgresStore(t)
+    defer teardown()
+
+    id := &bucket.Id{Auth: "tenant-a", Time: time.Now(), Name: "router.latency", Source: "web.1"}
+    if err := s.Put(&bucket.Bucket{Id: id, Vals: []float64{1}, Sum: 1, Count: 1}); err != nil {
+        t.Fatalf("Put: %s", err)
+    }
+
+    first, err := s.Scan(0)
+    if err != nil {
+        t.Fatalf("first Scan: %s", err)
+    }
+    if len(first) != 1 {
+        t.Fatalf("expected first Scan to claim the bucket, got %d", len(first))
+    }
+
+    second, err := s.Scan(0)
+    if err != nil {
+        t.Fatalf("second Scan: %s", err)
+    }
+    if len(second) != 0 {
+        t.Fatalf("expected second Scan to find nothing left to claim, got %d", len(second))
+    }
+}